@@ -0,0 +1,62 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package impl_test
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/internal/encoding/wire"
+	"google.golang.org/protobuf/internal/impl"
+	testpb "google.golang.org/protobuf/internal/testprotos/test"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/runtime/protoiface"
+)
+
+// TestValidateDefaultMaxBytesAllowsNestedMessage verifies that leaving
+// UnmarshalInput.MaxBytes unset permits at least one full traversal of the
+// buffer, even when it contains a nested submessage.
+func TestValidateDefaultMaxBytesAllowsNestedMessage(t *testing.T) {
+	m := &testpb.TestAllTypes{
+		OptionalNestedMessage: &testpb.TestAllTypes_NestedMessage{A: proto.Int32(1)},
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal() = %v", err)
+	}
+	_, status := impl.Validate(m.ProtoReflect().Type(), protoiface.UnmarshalInput{Buf: b})
+	if status == impl.ValidationInvalid {
+		t.Fatalf("Validate() with MaxBytes unset = ValidationInvalid for a %d-byte message containing one nested submessage; the default budget must permit a full traversal of the buffer", len(b))
+	}
+}
+
+// TestValidateMapEntryRepeatedKeyMatchesUnmarshal verifies that Validate does
+// not reject a map entry with a repeated key tag, since Unmarshal accepts it
+// with last-one-wins semantics.
+func TestValidateMapEntryRepeatedKeyMatchesUnmarshal(t *testing.T) {
+	fd := (&testpb.TestAllTypes{}).ProtoReflect().Descriptor().Fields().ByName("map_string_string")
+	if fd == nil || !fd.IsMap() {
+		t.Fatal("map_string_string: map field not found")
+	}
+
+	entry := wire.AppendTag(nil, 1, wire.BytesType)
+	entry = wire.AppendBytes(entry, []byte("discarded"))
+	entry = wire.AppendTag(entry, 1, wire.BytesType)
+	entry = wire.AppendBytes(entry, []byte("k"))
+	entry = wire.AppendTag(entry, 2, wire.BytesType)
+	entry = wire.AppendBytes(entry, []byte("v"))
+
+	b := wire.AppendTag(nil, wire.Number(fd.Number()), wire.BytesType)
+	b = wire.AppendBytes(b, entry)
+
+	var got testpb.TestAllTypes
+	if err := proto.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal() = %v, want success: a repeated map key is last-one-wins, not an error", err)
+	}
+
+	_, status := impl.Validate((&testpb.TestAllTypes{}).ProtoReflect().Type(), protoiface.UnmarshalInput{Buf: b})
+	if status == impl.ValidationInvalid {
+		t.Fatalf("Validate() = ValidationInvalid for a map entry with a repeated key tag, but Unmarshal() accepted it; Validate must not be stricter than Unmarshal")
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protoregistry
+
+// FrozenExtensionResolver is implemented by an ExtensionTypeResolver that
+// guarantees it will never resolve additional extensions after IsFrozen
+// first reports true. Code that validates or unmarshals untrusted input can
+// use this to treat an extension number that is not found as permanently
+// absent, rather than as a lookup that a later registration could overturn.
+type FrozenExtensionResolver interface {
+	ExtensionTypeResolver
+	IsFrozen() bool
+}
+
+// FreezeExtensions wraps r in a FrozenExtensionResolver whose IsFrozen
+// method always reports true. It does not copy or snapshot r: lookups are
+// forwarded to the live r, and FreezeExtensions is only as trustworthy as
+// the caller's promise not to register additional extensions with r after
+// passing it here. ExtensionTypeResolver has no way to enumerate or clone
+// an arbitrary implementation's contents, so a real snapshot isn't
+// possible in general; callers that need one must build r from an
+// already-closed set of extensions before freezing it. Violating the
+// no-further-registration promise silently stales any NotFound result a
+// caller has cached on the strength of IsFrozen.
+func FreezeExtensions(r ExtensionTypeResolver) FrozenExtensionResolver {
+	return frozenExtensionResolver{r}
+}
+
+type frozenExtensionResolver struct {
+	ExtensionTypeResolver
+}
+
+func (frozenExtensionResolver) IsFrozen() bool { return true }